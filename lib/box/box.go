@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package box
+
+import (
+	"io"
+
+	"github.com/opencontainers/runc/libcontainer"
+)
+
+// Box represents a started container and the processes running inside
+// it.
+type Box struct {
+	// Container is the libcontainer container processes are started
+	// in by the default runc Runtime.
+	Container libcontainer.Container
+	// RuntimeName selects the Runtime StartProcess drives processes
+	// through. Empty (or "runc") uses the in-process libcontainer
+	// runtime; any other value is looked up as a containerd shim v2
+	// runtime name (e.g. "kata", "gvisor", "crun").
+	RuntimeName string
+
+	selinuxLabelGetter selinuxLabelGetter
+}
+
+// selinuxLabelGetter resolves the SELinux process label a process
+// started from path should run under.
+type selinuxLabelGetter interface {
+	getSELinuxLabel(path string) string
+}
+
+// TTY describes the terminal dimensions of a process started with a TTY
+// attached.
+type TTY struct {
+	// W is the terminal width, in columns.
+	W int
+	// H is the terminal height, in rows.
+	H int
+}
+
+// ProcessConfig configures a process started with Box.StartProcess.
+type ProcessConfig struct {
+	// Args is the command and arguments to run.
+	Args []string
+	// User is the user (uid:gid) to run the process as.
+	User string
+	// Env is additional environment variables to set on the process,
+	// on top of the defaults from defaultProcessEnviron.
+	Env []string
+	// ProcessLabel is the SELinux label to run the process under. Left
+	// empty, it is resolved from the Box's selinuxLabelGetter, if any.
+	ProcessLabel string
+	// TTY requests a terminal be attached to the process, of the given
+	// dimensions. Leave nil for a process with ordinary stdio.
+	TTY *TTY
+	// In, if set, is copied into the process's stdin (or its TTY).
+	In io.Reader
+	// Out, if set, receives the process's stdout and stderr (or its
+	// TTY output).
+	Out io.Writer
+}
+
+// Environment returns the environment variables requested through Env.
+// The runtimes append defaultProcessEnviron to it.
+func (cfg ProcessConfig) Environment() []string {
+	return cfg.Env
+}
@@ -18,7 +18,6 @@ package box
 
 import (
 	"bytes"
-	"context"
 	"io"
 	"os"
 	"path"
@@ -26,13 +25,19 @@ import (
 	"strings"
 
 	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
 
 	"github.com/gravitational/trace"
 	"github.com/opencontainers/runc/libcontainer"
-	libcontainerutils "github.com/opencontainers/runc/libcontainer/utils"
 	log "github.com/sirupsen/logrus"
 )
 
+// cgroupControllersFile is present under the cgroup v2 mountpoint only
+// when the host boots with the unified hierarchy (e.g. distros started
+// with systemd.unified_cgroup_hierarchy=1). Its presence is the
+// documented way to tell v1 and v2 apart at runtime.
+const cgroupControllersFile = "/sys/fs/cgroup/cgroup.controllers"
+
 // CombinedOutput executes the command specified with cfg and returns
 // its output as a combination of stdout/stderr
 func (b *Box) CombinedOutput(cfg ProcessConfig) (output []byte, err error) {
@@ -57,42 +62,32 @@ func (b *Box) StartProcess(cfg ProcessConfig) error {
 		cfg.ProcessLabel = ""
 	}
 
-	if cfg.TTY != nil {
-		return b.startProcessTTY(cfg)
+	runtime, err := newRuntime(b.RuntimeName, b.Container)
+	if err != nil {
+		return trace.Wrap(err)
 	}
-	return b.startProcessStdout(cfg)
-}
 
-func (b *Box) startProcessTTY(cfg ProcessConfig) error {
-	p := &libcontainer.Process{
-		Args:          cfg.Args,
-		User:          cfg.User,
-		Env:           append(cfg.Environment(), defaultProcessEnviron()...),
-		ConsoleHeight: uint16(cfg.TTY.H),
-		ConsoleWidth:  uint16(cfg.TTY.W),
-		Label:         cfg.ProcessLabel,
+	if cfg.TTY != nil {
+		return b.startProcessTTY(runtime, cfg)
 	}
+	return b.startProcessStdout(runtime, cfg)
+}
 
-	parentConsole, childConsole, err := libcontainerutils.NewSockPair("console")
+func (b *Box) startProcessTTY(runtime Runtime, cfg ProcessConfig) error {
+	// this will cause the runtime to exec this binary again with "init"
+	// command line argument (this is the default setting), then our
+	// init() function comes into play
+	p, err := runtime.StartProcess(cfg)
 	if err != nil {
-		return trace.Wrap(err, "failed to create a console socket pair")
-	}
-	p.ConsoleSocket = childConsole
-
-	// this will cause libcontainer to exec this binary again
-	// with "init" command line argument.  (this is the default setting)
-	// then our init() function comes into play
-	if err := b.Container.Run(p); err != nil {
 		return trace.Wrap(err)
 	}
 	log.WithField("process", cfg).Debug("Process started.")
 
-	setProcessUserCgroup(b.Container, p)
-
-	containerConsole, err := getContainerConsole(context.TODO(), parentConsole)
-	if err != nil {
-		return trace.Wrap(err, "failed to create container console")
+	ttyProcess, ok := p.(TTYProcess)
+	if !ok {
+		return trace.BadParameter("runtime %q did not return a TTY-capable process", b.RuntimeName)
 	}
+	containerConsole := ttyProcess.Console()
 	defer containerConsole.Close()
 
 	// start copying output from the process of the container's console
@@ -119,48 +114,18 @@ func (b *Box) startProcessTTY(cfg ProcessConfig) error {
 	return trace.Wrap(err)
 }
 
-func (b *Box) startProcessStdout(cfg ProcessConfig) error {
-	var in io.Reader
-	if cfg.In != nil {
-		// we have to pass real pipe to libcontainer.Process because:
-		// Libcontainer uses exec.Cmd for entering the master process namespace.
-		// In case if standard exec.Cmd gets not a os.File as a parameter
-		// to it's Stdin property, it will wait until the read operation
-		// will finish in it's Wait method.
-		// As long as our web socket never closes on the client side right now
-		// this never happens, so this fixes the problem for now
-		r, w, err := os.Pipe()
-		if err != nil {
-			return trace.Wrap(err)
-		}
-		in = r
-		go func() {
-			io.Copy(w, cfg.In)
-			w.Close()
-		}()
-	}
-	p := &libcontainer.Process{
-		Args:   cfg.Args,
-		User:   cfg.User,
-		Stdout: cfg.Out,
-		Stdin:  in,
-		Stderr: cfg.Out,
-		Env:    append(cfg.Environment(), defaultProcessEnviron()...),
-		Label:  cfg.ProcessLabel,
-	}
-
-	// this will cause libcontainer to exec this binary again
-	// with "init" command line argument.  (this is the default setting)
-	// then our init() function comes into play
-	if err := b.Container.Start(p); err != nil {
+func (b *Box) startProcessStdout(runtime Runtime, cfg ProcessConfig) error {
+	// this will cause the runtime to exec this binary again with "init"
+	// command line argument (this is the default setting), then our
+	// init() function comes into play
+	p, err := runtime.StartProcess(cfg)
+	if err != nil {
 		return trace.Wrap(err)
 	}
 
-	setProcessUserCgroup(b.Container, p)
-
 	// wait for the process to finish
 	log.WithField("args", cfg.Args).Info("Wait for process.")
-	_, err := p.Wait()
+	_, err = p.Wait()
 	return trace.Wrap(err)
 }
 
@@ -188,30 +153,78 @@ func setProcessUserCgroupImpl(c libcontainer.Container, p *libcontainer.Process)
 		return trace.Wrap(err)
 	}
 
-	// This is a bit of a risk, try and use the cpu controller to identify the cgroup path. CgroupsV1 doesn't use a
-	// unified hierarchy, so different controllers can have different cgroup paths. For us, cpu is the most important
-	// controller, so we'll use it as the reference
-	cgroupPath, ok := state.CgroupPaths["cpu"]
+	if isUnifiedCgroupHierarchy() {
+		return trace.Wrap(addToUserCgroupV2(state.CgroupPaths, pid))
+	}
+	return trace.Wrap(addToUserCgroupV1(state.CgroupPaths, pid))
+}
+
+// isUnifiedCgroupHierarchy reports whether the host was booted with the
+// cgroup v2 unified hierarchy, as opposed to the legacy per-controller
+// v1 hierarchy runc defaults to assuming.
+func isUnifiedCgroupHierarchy() bool {
+	_, err := os.Stat(cgroupControllersFile)
+	return err == nil
+}
+
+// addToUserCgroupV1 adds pid to the /user sub-cgroup of the cpu
+// controller's cgroup, as derived from cgroupPaths.
+func addToUserCgroupV1(cgroupPaths map[string]string, pid int) error {
+	userPath, err := userCgroupPathV1(cgroupPaths)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	control, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(userPath))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(control.Add(cgroups.Process{Pid: pid}))
+}
+
+// userCgroupPathV1 derives the /user sub-cgroup path from cgroupPaths'
+// cpu controller entry. CgroupsV1 doesn't use a unified hierarchy, so
+// different controllers can have different cgroup paths; for us, cpu is
+// the most important controller, so we use it as the reference.
+func userCgroupPathV1(cgroupPaths map[string]string) (string, error) {
+	cgroupPath, ok := cgroupPaths["cpu"]
 	if !ok {
-		return trace.NotFound("cpu cgroup controller not found: %v", state.CgroupPaths)
+		return "", trace.NotFound("cpu cgroup controller not found: %v", cgroupPaths)
 	}
 
 	if !strings.HasPrefix(cgroupPath, "/sys/fs/cgroup/") {
-		return trace.BadParameter("Cgroup path not mounted to /sys/fs/cgroup: %v", cgroupPath)
+		return "", trace.BadParameter("Cgroup path not mounted to /sys/fs/cgroup: %v", cgroupPath)
 	}
 
 	// Example cgroup path: /sys/fs/cgroup/cpu,cpuacct/system.slice/-planet-cee2b8a0-c470-44a6-b7cc-1eefbc1cc88c.scope
 	// we want to split off the /sys/fs/cgroup/cpu,cpuacct/ part, so we have just the cgroup structure
 	// (system.slice/-planet-cee2b8a0-c470-44a6-b7cc-1eefbc1cc88c.scope)
 	dirs := strings.Split(cgroupPath, "/")
-	userPath := filepath.Join("/", path.Join(dirs[5:]...), "user")
+	return filepath.Join("/", path.Join(dirs[5:]...), "user"), nil
+}
 
-	control, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(userPath))
+// addToUserCgroupV2 adds pid to the /user sub-cgroup of the unified
+// hierarchy's single cgroup path, as derived from cgroupPaths.
+func addToUserCgroupV2(cgroupPaths map[string]string, pid int) error {
+	userPath, err := userCgroupPathV2(cgroupPaths)
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	manager, err := cgroupsv2.NewManager("/sys/fs/cgroup", userPath, &cgroupsv2.Resources{})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(manager.AddProc(uint64(pid)))
+}
 
-	return trace.Wrap(control.Add(cgroups.Process{Pid: pid}))
+// userCgroupPathV2 derives the /user sub-cgroup path from cgroupPaths'
+// unified hierarchy entry. runc sets this under the empty string key,
+// since cgroup v2 has only one controller path per container.
+func userCgroupPathV2(cgroupPaths map[string]string) (string, error) {
+	cgroupPath, ok := cgroupPaths[""]
+	if !ok {
+		return "", trace.NotFound("unified cgroup path not found: %v", cgroupPaths)
+	}
+	return filepath.Join("/", cgroupPath, "user"), nil
 }
 
 func defaultProcessEnviron() []string {
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package box
+
+import "testing"
+
+func TestUserCgroupPathV1(t *testing.T) {
+	cgroupPaths := map[string]string{
+		"cpu": "/sys/fs/cgroup/cpu,cpuacct/system.slice/-planet-cee2b8a0-c470-44a6-b7cc-1eefbc1cc88c.scope",
+	}
+	path, err := userCgroupPathV1(cgroupPaths)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "/system.slice/-planet-cee2b8a0-c470-44a6-b7cc-1eefbc1cc88c.scope/user"
+	if path != expected {
+		t.Fatalf("expected %q, got %q", expected, path)
+	}
+}
+
+func TestUserCgroupPathV1MissingController(t *testing.T) {
+	cgroupPaths := map[string]string{
+		"memory": "/sys/fs/cgroup/memory/system.slice",
+	}
+	if _, err := userCgroupPathV1(cgroupPaths); err == nil {
+		t.Fatal("expected an error for missing cpu controller")
+	}
+}
+
+func TestUserCgroupPathV1NotMountedUnderSysFsCgroup(t *testing.T) {
+	cgroupPaths := map[string]string{
+		"cpu": "/some/other/path",
+	}
+	if _, err := userCgroupPathV1(cgroupPaths); err == nil {
+		t.Fatal("expected an error for a cpu path not under /sys/fs/cgroup")
+	}
+}
+
+func TestUserCgroupPathV2(t *testing.T) {
+	cgroupPaths := map[string]string{
+		"": "system.slice/-planet-cee2b8a0-c470-44a6-b7cc-1eefbc1cc88c.scope",
+	}
+	path, err := userCgroupPathV2(cgroupPaths)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "/system.slice/-planet-cee2b8a0-c470-44a6-b7cc-1eefbc1cc88c.scope/user"
+	if path != expected {
+		t.Fatalf("expected %q, got %q", expected, path)
+	}
+}
+
+func TestUserCgroupPathV2MissingUnifiedPath(t *testing.T) {
+	cgroupPaths := map[string]string{
+		"cpu": "/sys/fs/cgroup/cpu,cpuacct/system.slice",
+	}
+	if _, err := userCgroupPathV2(cgroupPaths); err == nil {
+		t.Fatal("expected an error for a v1-shaped CgroupPaths map")
+	}
+}
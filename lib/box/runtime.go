@@ -0,0 +1,335 @@
+/*
+Copyright 2018 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package box
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gravitational/trace"
+
+	"github.com/opencontainers/runc/libcontainer"
+	libcontainerutils "github.com/opencontainers/runc/libcontainer/utils"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// runtimeRunc is the name of the default, in-process runc runtime. It is
+// used when Box.RuntimeName is unset, for backwards compatibility with
+// callers that never set it.
+const runtimeRunc = "runc"
+
+// Process is a handle to a process started by a Runtime.
+type Process interface {
+	// Pid returns the process's pid in the root PID namespace.
+	Pid() (int, error)
+	// Wait blocks until the process exits and returns its exit status.
+	Wait() (int, error)
+}
+
+// TTYProcess is implemented by a Process started with a TTY attached;
+// Console gives access to the process's end of the pty for relaying
+// input and output.
+type TTYProcess interface {
+	Process
+	Console() io.ReadWriteCloser
+}
+
+// Runtime abstracts the OCI container runtime a Box's processes are
+// started through, so StartProcess is not hard-wired to libcontainer
+// (runc). Implementations are responsible for turning a ProcessConfig
+// into a running process under whichever runtime they drive. When
+// cfg.TTY is set, Box.StartProcess needs the returned Process to
+// additionally implement TTYProcess, and fails if it does not.
+type Runtime interface {
+	// StartProcess starts cfg's process and returns a handle to it
+	// without waiting for it to complete.
+	StartProcess(cfg ProcessConfig) (Process, error)
+}
+
+// newRuntime returns the Runtime implementation named by runtimeName,
+// driving container c. An empty runtimeName (or "runc") selects the
+// existing in-process libcontainer runtime; anything else is driven
+// through a containerd shim v2 of the matching name (e.g. "kata",
+// "gvisor", "crun" via containerd-shim-runc-v2).
+func newRuntime(runtimeName string, c libcontainer.Container) (Runtime, error) {
+	switch runtimeName {
+	case "", runtimeRunc:
+		return &runcRuntime{container: c}, nil
+	default:
+		shimPath, err := shimPathForRuntime(runtimeName)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &containerdRuntime{container: c, runtimeName: runtimeName, shimPath: shimPath}, nil
+	}
+}
+
+// bundlePath creates a fresh OCI bundle directory for one of container
+// c's non-runc processes and returns its path. It is rooted alongside
+// the container's own rootfs so it is torn down together with
+// everything else.
+func bundlePath(c libcontainer.Container) (string, error) {
+	state, err := c.State()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	path, err := ioutil.TempDir(filepath.Dir(state.Rootfs), "oci-bundle-"+state.BaseState.ID+"-")
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create OCI bundle directory")
+	}
+	return path, nil
+}
+
+// writeOCIBundle serializes cfg as an OCI runtime spec config.json,
+// referencing container c's existing rootfs, into a fresh bundle
+// directory, and returns the bundle's path. containerd shims expect to
+// find config.json directly under the bundle directory they are given.
+func writeOCIBundle(c libcontainer.Container, cfg ProcessConfig) (string, error) {
+	path, err := bundlePath(c)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return "", trace.Wrap(err, "failed to create OCI bundle directory")
+	}
+
+	state, err := c.State()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	user, err := parseOCIUser(cfg.User)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	spec := &specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{
+			Args:         cfg.Args,
+			Env:          append(cfg.Environment(), defaultProcessEnviron()...),
+			Cwd:          "/",
+			Terminal:     cfg.TTY != nil,
+			User:         user,
+			SelinuxLabel: cfg.ProcessLabel,
+		},
+		Root: &specs.Root{
+			Path: state.Rootfs,
+		},
+		Mounts: defaultOCIMounts(),
+		Linux: &specs.Linux{
+			Namespaces:  defaultOCINamespaces(),
+			CgroupsPath: filepath.Join("/planet", state.BaseState.ID),
+		},
+	}
+
+	f, err := os.Create(filepath.Join(path, "config.json"))
+	if err != nil {
+		return "", trace.Wrap(err, "failed to create OCI bundle config")
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(spec); err != nil {
+		return "", trace.Wrap(err, "failed to encode OCI bundle config")
+	}
+	return path, nil
+}
+
+// parseOCIUser parses a ProcessConfig.User string of the form "uid:gid"
+// into an OCI spec User, matching the format libcontainer.Process.User
+// already expects. An empty user runs the process as root, same as
+// leaving libcontainer.Process.User unset.
+func parseOCIUser(user string) (specs.User, error) {
+	if user == "" {
+		return specs.User{}, nil
+	}
+	parts := strings.SplitN(user, ":", 2)
+	if len(parts) != 2 {
+		return specs.User{}, trace.BadParameter("expected uid:gid, got %q", user)
+	}
+	uidN, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return specs.User{}, trace.Wrap(err, "invalid uid in %q", user)
+	}
+	gidN, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return specs.User{}, trace.Wrap(err, "invalid gid in %q", user)
+	}
+	return specs.User{UID: uint32(uidN), GID: uint32(gidN)}, nil
+}
+
+// defaultOCINamespaces returns the set of namespaces every runtime-driven
+// process is isolated under: mount, pid, uts, ipc and network, the same
+// isolation libcontainer already provides the runcRuntime path.
+func defaultOCINamespaces() []specs.LinuxNamespace {
+	return []specs.LinuxNamespace{
+		{Type: specs.MountNamespace},
+		{Type: specs.PIDNamespace},
+		{Type: specs.UTSNamespace},
+		{Type: specs.IPCNamespace},
+		{Type: specs.NetworkNamespace},
+	}
+}
+
+// defaultOCIMounts returns the standard proc/sys/dev mounts every OCI
+// bundle needs for a usable container, mirroring runc's own default
+// spec.
+func defaultOCIMounts() []specs.Mount {
+	return []specs.Mount{
+		{
+			Destination: "/proc",
+			Type:        "proc",
+			Source:      "proc",
+		},
+		{
+			Destination: "/dev",
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
+		},
+		{
+			Destination: "/dev/pts",
+			Type:        "devpts",
+			Source:      "devpts",
+			Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"},
+		},
+		{
+			Destination: "/dev/shm",
+			Type:        "tmpfs",
+			Source:      "shm",
+			Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"},
+		},
+		{
+			Destination: "/dev/mqueue",
+			Type:        "mqueue",
+			Source:      "mqueue",
+			Options:     []string{"nosuid", "noexec", "nodev"},
+		},
+		{
+			Destination: "/sys",
+			Type:        "sysfs",
+			Source:      "sysfs",
+			Options:     []string{"nosuid", "noexec", "nodev", "ro"},
+		},
+	}
+}
+
+// runcRuntime is the default Runtime, driving the box's own libcontainer
+// container directly - this is the pre-existing behavior, moved behind
+// the Runtime interface.
+type runcRuntime struct {
+	container libcontainer.Container
+}
+
+// StartProcess starts cfg's process under the box's libcontainer
+// container, choosing Run or Start depending on whether a TTY was
+// requested, exactly as Box.StartProcess did before the Runtime
+// abstraction was introduced.
+func (r *runcRuntime) StartProcess(cfg ProcessConfig) (Process, error) {
+	if cfg.TTY != nil {
+		return r.startTTY(cfg)
+	}
+	return r.startStdout(cfg)
+}
+
+func (r *runcRuntime) startTTY(cfg ProcessConfig) (Process, error) {
+	p := &libcontainer.Process{
+		Args:          cfg.Args,
+		User:          cfg.User,
+		Env:           append(cfg.Environment(), defaultProcessEnviron()...),
+		ConsoleHeight: uint16(cfg.TTY.H),
+		ConsoleWidth:  uint16(cfg.TTY.W),
+		Label:         cfg.ProcessLabel,
+	}
+
+	parentConsole, childConsole, err := libcontainerutils.NewSockPair("console")
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create a console socket pair")
+	}
+	p.ConsoleSocket = childConsole
+
+	if err := r.container.Run(p); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	setProcessUserCgroup(r.container, p)
+
+	console, err := getContainerConsole(context.TODO(), parentConsole)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to create container console")
+	}
+	return runcProcess{Process: p, console: console}, nil
+}
+
+func (r *runcRuntime) startStdout(cfg ProcessConfig) (Process, error) {
+	var in io.Reader
+	if cfg.In != nil {
+		// we have to pass a real pipe to libcontainer.Process because
+		// libcontainer uses exec.Cmd, and exec.Cmd waits for the read
+		// side of Stdin to close in its Wait method if it isn't an
+		// *os.File - this never happens for our web socket, so this
+		// works around it
+		pipeR, pipeW, err := os.Pipe()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		in = pipeR
+		go func() {
+			io.Copy(pipeW, cfg.In)
+			pipeW.Close()
+		}()
+	}
+	p := &libcontainer.Process{
+		Args:   cfg.Args,
+		User:   cfg.User,
+		Stdout: cfg.Out,
+		Stdin:  in,
+		Stderr: cfg.Out,
+		Env:    append(cfg.Environment(), defaultProcessEnviron()...),
+		Label:  cfg.ProcessLabel,
+	}
+
+	if err := r.container.Start(p); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	setProcessUserCgroup(r.container, p)
+	return runcProcess{Process: p}, nil
+}
+
+// runcProcess adapts *libcontainer.Process to the Process/TTYProcess
+// interfaces.
+type runcProcess struct {
+	*libcontainer.Process
+	console io.ReadWriteCloser
+}
+
+func (p runcProcess) Wait() (int, error) {
+	state, err := p.Process.Wait()
+	if err != nil {
+		return -1, trace.Wrap(err)
+	}
+	return state.ExitCode(), nil
+}
+
+func (p runcProcess) Console() io.ReadWriteCloser {
+	return p.console
+}
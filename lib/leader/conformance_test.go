@@ -0,0 +1,110 @@
+package leader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/integration"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestLeaderElectorConformance runs the same Campaign/Get/Observe
+// exercise against every LeaderElector backend, so a bug in one
+// backend's read path (such as Get/Observe resolving a different key
+// than Campaign writes to) can't hide behind tests that only ever
+// check one backend's own internals.
+func TestLeaderElectorConformance(t *testing.T) {
+	backends := []struct {
+		name       string
+		newElector func(t *testing.T) (LeaderElector, func())
+	}{
+		{"etcd", newTestEtcdElector},
+		{"kube-lease", newTestKubeElector},
+	}
+
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			elector, teardown := b.newElector(t)
+			defer teardown()
+			testCampaignGetObserve(t, elector)
+		})
+	}
+}
+
+// testCampaignGetObserve campaigns for a key, then checks that Get and
+// Observe both agree with what Campaign just won - the property chunk0-1
+// broke for etcdElector, whose Get/Observe read the literal key while
+// Campaign's concurrency.Election wrote to a child key under it.
+func testCampaignGetObserve(t *testing.T, elector LeaderElector) {
+	const key = "conformance-key"
+	const value = "candidate-1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := elector.Campaign(ctx, key, value); err != nil {
+		t.Fatalf("Campaign: unexpected error: %v", err)
+	}
+
+	gotValue, gotToken, err := elector.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if gotValue != value {
+		t.Fatalf("Get: value = %q, want %q", gotValue, value)
+	}
+	if gotToken == 0 {
+		t.Fatal("Get: token = 0, want a non-zero fencing token for a won campaign")
+	}
+
+	select {
+	case ev, ok := <-elector.Observe(ctx, key, 100*time.Millisecond):
+		if !ok {
+			t.Fatal("Observe: channel closed before delivering the current leader")
+		}
+		if ev.NewValue != value {
+			t.Fatalf("Observe: NewValue = %q, want %q", ev.NewValue, value)
+		}
+		if ev.Token != gotToken {
+			t.Fatalf("Observe: Token = %v, want %v (from Get)", ev.Token, gotToken)
+		}
+	case <-ctx.Done():
+		t.Fatal("Observe: timed out waiting for the current leader")
+	}
+
+	if err := elector.Resign(ctx, key); err != nil {
+		t.Fatalf("Resign: unexpected error: %v", err)
+	}
+}
+
+// newTestEtcdElector stands up a single-member embedded etcd cluster
+// and an etcdElector backed by it, since Campaign/Get/Observe's
+// agreement depends on the real clientv3 concurrency package rather
+// than anything fakeable.
+func newTestEtcdElector(t *testing.T) (LeaderElector, func()) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	elector := &etcdElector{
+		client:     clus.RandClient(),
+		sessionTTL: time.Second,
+		campaigns:  make(map[string]*etcdCampaign),
+	}
+	return elector, func() {
+		elector.Close()
+		clus.Terminate(t)
+	}
+}
+
+// newTestKubeElector returns a kubeElector backed by a fake clientset,
+// the same approach the backend-specific kube_elector_test.go tests
+// already use.
+func newTestKubeElector(t *testing.T) (LeaderElector, func()) {
+	elector := &kubeElector{
+		client:     fake.NewSimpleClientset(),
+		namespace:  "kube-system",
+		sessionTTL: time.Second,
+		stopped:    make(map[string]chan struct{}),
+	}
+	return elector, func() { elector.Close() }
+}
@@ -0,0 +1,73 @@
+package leader
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Backend selects the coordination system Client uses to campaign for
+// and observe leadership.
+type Backend string
+
+const (
+	// BackendETCD coordinates leadership through etcd, using the
+	// clientv3 concurrency package (sessions, leases and elections).
+	BackendETCD Backend = "etcd"
+	// BackendKubeLease coordinates leadership through
+	// coordination.k8s.io/v1 Lease objects - the same primitive
+	// client-go's leaderelection package uses. Useful for planet
+	// clusters that already run on a Kubernetes control plane and want
+	// to avoid standing up a separate etcd quorum just for in-cluster
+	// leader election of subsystems like the registry or monitoring
+	// sidecars.
+	BackendKubeLease Backend = "kube-lease"
+)
+
+// LeaderEvent describes a change observed for a single key under
+// leader election - either the initial value seen, or a transition from
+// one value to another.
+type LeaderEvent struct {
+	// Key is the key the change applies to.
+	Key string
+	// PrevValue is the key's value before this change, or "" if none
+	// was previously observed.
+	PrevValue string
+	// NewValue is the key's current value, or "" if the key (and the
+	// leadership it represented) was removed.
+	NewValue string
+	// Token is the fencing token (backend-specific monotonic counter)
+	// for NewValue.
+	Token int64
+}
+
+// LeaderElector abstracts the coordination backend Client uses to
+// campaign for and observe leadership, so the backend-specific
+// session/lease machinery can be swapped out - for an etcd cluster, a
+// Kubernetes control plane, or anything else that can offer these six
+// operations - without touching Client's voter/watch API above it.
+type LeaderElector interface {
+	// Campaign blocks until value wins the campaign for key, or ctx is
+	// canceled first. Call it again to re-campaign once a previous win
+	// is lost, which is reported through Observe as a transition away
+	// from value.
+	Campaign(ctx context.Context, key, value string) error
+	// Resign gives up a campaign previously won for key.
+	Resign(ctx context.Context, key string) error
+	// Get returns the current value and fencing token for key, or
+	// ("", 0, nil) if key has no value.
+	Get(ctx context.Context, key string) (value string, token int64, err error)
+	// Observe streams leadership changes for key on the returned
+	// channel, seeding it with the current value first, until ctx is
+	// canceled, at which point the channel is closed. retry is the
+	// interval to retry on transient read errors.
+	Observe(ctx context.Context, key string, retry time.Duration) <-chan LeaderEvent
+	// Watch streams create/update/delete events for every key under
+	// prefix on the returned channel until ctx is canceled, at which
+	// point the channel is closed. retry is the interval to retry on
+	// transient read errors.
+	Watch(ctx context.Context, prefix string, retry time.Duration) <-chan PrefixEvent
+	// Close releases the elector's resources. etcdElector also resigns
+	// any campaigns still held; kubeElector only stops renewing them.
+	Close() error
+}
@@ -0,0 +1,349 @@
+package leader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// etcdElector is the default LeaderElector, backed by etcd clientv3's
+// concurrency package: a concurrency.Session maintains a lease with an
+// async keepalive stream and auto-revokes it on close, and
+// concurrency.Election layers campaign/resign/observe semantics on top,
+// so no polling or manual TTL renewal is needed.
+type etcdElector struct {
+	client     *clientv3.Client
+	sessionTTL time.Duration
+
+	mu        sync.Mutex
+	campaigns map[string]*etcdCampaign
+}
+
+// etcdCampaign is the session and election backing a won campaign, kept
+// around so a later Resign can give it up cleanly.
+type etcdCampaign struct {
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+func newEtcdElector(cfg Config) (*etcdElector, error) {
+	if len(cfg.ETCD.Endpoints) == 0 {
+		return nil, trace.Errorf("need at least one endpoint")
+	}
+	client, err := cfg.ETCD.NewClientV3()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &etcdElector{
+		client:     client,
+		sessionTTL: cfg.SessionTTL,
+		campaigns:  make(map[string]*etcdCampaign),
+	}, nil
+}
+
+// Campaign blocks until value wins the campaign for key. The session
+// backing the win is tracked so a later Resign can find it; if this
+// process never resigns and simply disappears, the session's lease
+// expires on its own after the configured SessionTTL and etcd deletes
+// the key, which Observe reports as a transition to "".
+func (e *etcdElector) Campaign(ctx context.Context, key, value string) error {
+	session, err := concurrency.NewSession(e.client,
+		concurrency.WithTTL(int(e.sessionTTL/time.Second)),
+		concurrency.WithContext(ctx))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	fields := log.Fields{"key": key, "candidate": value, "lease_id": int64(session.Lease())}
+	election := concurrency.NewElection(session, key)
+	if err := election.Campaign(ctx, value); err != nil {
+		session.Close()
+		log.WithFields(fields).WithError(err).Info("Campaign error.")
+		return trace.Wrap(err)
+	}
+
+	e.mu.Lock()
+	e.campaigns[key] = &etcdCampaign{session: session, election: election}
+	e.mu.Unlock()
+	return nil
+}
+
+// Resign gives up the campaign previously won for key, if any.
+func (e *etcdElector) Resign(ctx context.Context, key string) error {
+	e.mu.Lock()
+	c, ok := e.campaigns[key]
+	if ok {
+		delete(e.campaigns, key)
+	}
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	err := c.election.Resign(ctx)
+	log.WithFields(log.Fields{"key": key, "lease_id": int64(c.session.Lease())}).WithError(err).Info("Resigned.")
+	c.session.Close()
+	return trace.Wrap(err)
+}
+
+// Get returns the current leader's value and mod revision (used as the
+// fencing token) for key, resolved the same way Campaign elects one:
+// via concurrency.Election, which tracks a child key under key rather
+// than key itself.
+func (e *etcdElector) Get(ctx context.Context, key string) (string, int64, error) {
+	if election := e.heldElection(key); election != nil {
+		return leaderFromElection(ctx, election)
+	}
+
+	session, err := concurrency.NewSession(e.client, concurrency.WithContext(ctx))
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	defer session.Close()
+	return leaderFromElection(ctx, concurrency.NewElection(session, key))
+}
+
+// heldElection returns the Election backing a campaign this elector
+// itself has won for key, or nil if it hasn't (or has since resigned).
+func (e *etcdElector) heldElection(key string) *concurrency.Election {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.campaigns[key]
+	if !ok {
+		return nil
+	}
+	return c.election
+}
+
+// leaderFromElection resolves election's current leader via its
+// tracked child key, translating concurrency.ErrElectionNoLeader into
+// the "no value yet" zero result other backends report for an unset
+// key.
+func leaderFromElection(ctx context.Context, election *concurrency.Election) (string, int64, error) {
+	resp, err := election.Leader(ctx)
+	if err == concurrency.ErrElectionNoLeader {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	return string(resp.Kvs[0].Value), resp.Kvs[0].ModRevision, nil
+}
+
+// Observe streams leadership transitions for key via
+// concurrency.Election.Observe, which already seeds the current leader
+// and resumes across a leader handoff on its own; this only needs to
+// rebuild the Election and retry if its channel closes early (a
+// connection error, since Observe only returns on ctx.Done() or a real
+// client error).
+func (e *etcdElector) Observe(ctx context.Context, key string, retry time.Duration) <-chan LeaderEvent {
+	eventsC := make(chan LeaderEvent)
+	go e.observeKey(ctx, key, retry, eventsC)
+	return eventsC
+}
+
+func (e *etcdElector) observeKey(ctx context.Context, key string, retry time.Duration, eventsC chan LeaderEvent) {
+	defer close(eventsC)
+
+	var prev string
+	for {
+		election, closeSession, err := e.electionFor(ctx, key)
+		if err != nil {
+			log.WithField("key", key).WithError(err).Info("Failed to resolve election, retrying.")
+		} else {
+			for resp := range election.Observe(ctx) {
+				if len(resp.Kvs) == 0 {
+					continue
+				}
+				newValue := string(resp.Kvs[0].Value)
+				select {
+				case eventsC <- LeaderEvent{Key: key, PrevValue: prev, NewValue: newValue, Token: resp.Kvs[0].ModRevision}:
+					prev = newValue
+				case <-ctx.Done():
+					closeSession()
+					return
+				}
+			}
+			closeSession()
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			watchResetsTotal.WithLabelValues(reasonUnknown).Inc()
+			log.WithField("key", key).Info("Observe channel closed, re-seeding.")
+		}
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// electionFor returns the Election tracking key, reusing the live
+// election backing a campaign this elector itself won for key (so
+// watching your own win doesn't need a second session), otherwise a
+// fresh ephemeral session/election pair whose session the caller must
+// close via the returned func once done with it.
+func (e *etcdElector) electionFor(ctx context.Context, key string) (*concurrency.Election, func(), error) {
+	if election := e.heldElection(key); election != nil {
+		return election, func() {}, nil
+	}
+	session, err := concurrency.NewSession(e.client, concurrency.WithContext(ctx))
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	return concurrency.NewElection(session, key), func() { session.Close() }, nil
+}
+
+// Watch seeds the returned channel with the current set of keys under
+// prefix, then resumes a clientv3 prefix watch at the seeded revision
+// plus one. On compaction, it re-seeds from a fresh Get and emits
+// synthetic events for anything that changed during the gap.
+func (e *etcdElector) Watch(ctx context.Context, prefix string, retry time.Duration) <-chan PrefixEvent {
+	eventsC := make(chan PrefixEvent)
+	go e.watchPrefix(ctx, prefix, retry, eventsC)
+	return eventsC
+}
+
+func (e *etcdElector) watchPrefix(ctx context.Context, prefix string, retry time.Duration, eventsC chan PrefixEvent) {
+	defer close(eventsC)
+
+	state := make(map[string]string)
+	rev, ok := e.seedPrefix(ctx, prefix, retry, state, eventsC)
+	if !ok {
+		return
+	}
+
+	for {
+		watchC := e.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for resp := range watchC {
+			if err := resp.Err(); err != nil {
+				reason := classifyWatchErr(err)
+				watchResetsTotal.WithLabelValues(reason).Inc()
+				log.WithFields(log.Fields{"key": prefix, "mod_revision": rev}).WithError(err).Infof("Watch error (%v), re-seeding.", reason)
+				break
+			}
+			for _, ev := range resp.Events {
+				rev = ev.Kv.ModRevision
+				key := string(ev.Kv.Key)
+				if ev.Type == clientv3.EventTypeDelete {
+					prevValue := state[key]
+					delete(state, key)
+					select {
+					case eventsC <- PrefixEvent{Key: key, PrevValue: prevValue, Type: Delete}:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				prevValue := state[key]
+				newValue := string(ev.Kv.Value)
+				state[key] = newValue
+				select {
+				case eventsC <- PrefixEvent{Key: key, PrevValue: prevValue, NewValue: newValue, Type: Put}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		rev, ok = e.seedPrefix(ctx, prefix, retry, state, eventsC)
+		if !ok {
+			return
+		}
+	}
+}
+
+// seedPrefix fetches the current set of keys under prefix, retrying
+// every retryPeriod until the Get succeeds, diffs it against state and
+// emits a synthetic PrefixEvent for every key added, changed or removed
+// since state was last populated, then updates state in place. It
+// returns the header revision of the Get, to resume the watch from.
+func (e *etcdElector) seedPrefix(ctx context.Context, prefix string, retryPeriod time.Duration, state map[string]string, eventsC chan PrefixEvent) (int64, bool) {
+	tick := time.NewTicker(retryPeriod)
+	defer tick.Stop()
+	for {
+		resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+		if err == nil {
+			seen := make(map[string]bool, len(resp.Kvs))
+			for _, kv := range resp.Kvs {
+				key := string(kv.Key)
+				seen[key] = true
+				newValue := string(kv.Value)
+				if prevValue, ok := state[key]; !ok || prevValue != newValue {
+					prevValue := state[key]
+					state[key] = newValue
+					select {
+					case eventsC <- PrefixEvent{Key: key, PrevValue: prevValue, NewValue: newValue, Type: Put}:
+					case <-ctx.Done():
+						return 0, false
+					}
+				}
+			}
+			for key, prevValue := range state {
+				if seen[key] {
+					continue
+				}
+				delete(state, key)
+				select {
+				case eventsC <- PrefixEvent{Key: key, PrevValue: prevValue, Type: Delete}:
+				case <-ctx.Done():
+					return 0, false
+				}
+			}
+			return resp.Header.Revision, true
+		}
+		log.WithField("key", prefix).WithError(err).Info("Unexpected error seeding prefix watch.")
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return 0, false
+		}
+	}
+}
+
+// Close resigns any campaigns still held and closes the etcd client.
+func (e *etcdElector) Close() error {
+	e.mu.Lock()
+	campaigns := e.campaigns
+	e.campaigns = nil
+	e.mu.Unlock()
+
+	for key, c := range campaigns {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := c.election.Resign(ctx); err != nil {
+			log.WithField("key", key).WithError(err).Info("Resign error.")
+		}
+		cancel()
+		c.session.Close()
+	}
+	return trace.Wrap(e.client.Close())
+}
+
+// classifyWatchErr maps a watch error to the reason label used by
+// planet_leader_watch_resets_total.
+func classifyWatchErr(err error) string {
+	switch {
+	case err == rpctypes.ErrCompacted:
+		return reasonCompacted
+	case status.Code(err) == codes.Unavailable || status.Code(err) == codes.DeadlineExceeded:
+		return reasonClusterError
+	default:
+		return reasonUnknown
+	}
+}
@@ -0,0 +1,44 @@
+package leader
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyWatchErr(t *testing.T) {
+	testCases := []struct {
+		comment string
+		err     error
+		reason  string
+	}{
+		{
+			comment: "compacted revision",
+			err:     rpctypes.ErrCompacted,
+			reason:  reasonCompacted,
+		},
+		{
+			comment: "cluster unavailable",
+			err:     status.Error(codes.Unavailable, "no available endpoints"),
+			reason:  reasonClusterError,
+		},
+		{
+			comment: "deadline exceeded",
+			err:     status.Error(codes.DeadlineExceeded, "context deadline exceeded"),
+			reason:  reasonClusterError,
+		},
+		{
+			comment: "anything else",
+			err:     errors.New("boom"),
+			reason:  reasonUnknown,
+		},
+	}
+	for _, testCase := range testCases {
+		if got := classifyWatchErr(testCase.err); got != testCase.reason {
+			t.Errorf("%v: classifyWatchErr() = %v, want %v", testCase.comment, got, testCase.reason)
+		}
+	}
+}
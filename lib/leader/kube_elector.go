@@ -0,0 +1,328 @@
+package leader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+
+	log "github.com/Sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"golang.org/x/net/context"
+)
+
+// defaultKubeNamespace is the namespace Lease objects are created in
+// when Config.Namespace is unset.
+const defaultKubeNamespace = "kube-system"
+
+// kubeElector is a LeaderElector backed by coordination.k8s.io/v1 Lease
+// objects, the same primitive client-go's leaderelection package uses.
+// It lets planet clusters that already run on a Kubernetes control
+// plane elect leaders for in-cluster subsystems without standing up a
+// separate etcd quorum. A key maps to a Lease name; the fencing token
+// is the Lease object's Generation, which Kubernetes increments on
+// every successful spec update, giving the same "did I really win the
+// latest campaign" guarantee as an etcd mod revision.
+type kubeElector struct {
+	client     kubernetes.Interface
+	namespace  string
+	sessionTTL time.Duration
+
+	mu      sync.Mutex
+	stopped map[string]chan struct{}
+}
+
+func newKubeElector(cfg Config) (*kubeElector, error) {
+	restCfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, trace.Wrap(err, "BackendKubeLease requires running inside a Kubernetes cluster")
+	}
+	client, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = defaultKubeNamespace
+	}
+	return &kubeElector{
+		client:     client,
+		namespace:  namespace,
+		sessionTTL: cfg.SessionTTL,
+		stopped:    make(map[string]chan struct{}),
+	}, nil
+}
+
+// Campaign repeatedly tries to create or take over the Lease named key
+// until value wins it, sleeping SessionTTL/5 between attempts. A Lease
+// is won by creating it if absent, or by updating a Lease whose
+// RenewTime is older than its Spec.LeaseDurationSeconds - the same
+// expiry rule client-go's leaderelection uses.
+func (e *kubeElector) Campaign(ctx context.Context, key, value string) error {
+	ticker := time.NewTicker(e.sessionTTL / 5)
+	defer ticker.Stop()
+	for {
+		won, err := e.tryAcquire(ctx, key, value)
+		if err != nil {
+			log.WithFields(log.Fields{"key": key, "candidate": value}).WithError(err).Info("Campaign error.")
+		} else if won {
+			e.startRenewing(key, value)
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		}
+	}
+}
+
+func (e *kubeElector) tryAcquire(ctx context.Context, key, value string) (bool, error) {
+	leases := e.client.CoordinationV1().Leases(e.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(e.sessionTTL / time.Second)
+
+	lease, err := leases.Get(ctx, key, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, createErr := leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: key, Namespace: e.namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       strPtr(value),
+				LeaseDurationSeconds: &durationSeconds,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(createErr) {
+			return false, nil
+		}
+		return createErr == nil, trace.Wrap(createErr)
+	}
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == value {
+		// already the holder, just renew
+		lease.Spec.RenewTime = &now
+		_, updateErr := leases.Update(ctx, lease, metav1.UpdateOptions{})
+		return updateErr == nil, trace.Wrap(updateErr)
+	}
+
+	if !leaseExpired(lease) {
+		return false, nil
+	}
+
+	lease.Spec.HolderIdentity = strPtr(value)
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &now
+	_, updateErr := leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(updateErr) {
+		// someone else updated it first, try again next tick
+		return false, nil
+	}
+	return updateErr == nil, trace.Wrap(updateErr)
+}
+
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	deadline := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().After(deadline)
+}
+
+// startRenewing keeps the Lease alive by renewing RenewTime every
+// SessionTTL/5 for as long as this elector holds key, translating a
+// failure to renew into the same "leader lost" signal Observe reports
+// for any other holder change.
+func (e *kubeElector) startRenewing(key, value string) {
+	stopC := make(chan struct{})
+	e.mu.Lock()
+	e.stopped[key] = stopC
+	e.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(e.sessionTTL / 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				start := time.Now()
+				ctx, cancel := context.WithTimeout(context.Background(), e.sessionTTL/5)
+				won, err := e.tryAcquire(ctx, key, value)
+				cancel()
+				renewalLatency.Observe(time.Since(start).Seconds())
+				if err != nil || !won {
+					e.mu.Lock()
+					if e.stopped[key] == stopC {
+						delete(e.stopped, key)
+					}
+					e.mu.Unlock()
+					renewalFailuresTotal.Inc()
+					log.WithFields(log.Fields{"key": key, "candidate": value}).WithError(err).Info("Lease renewal failed, giving up holder identity.")
+					return
+				}
+			case <-stopC:
+				return
+			}
+		}
+	}()
+}
+
+// Resign gives up the Lease named key, if still held by this elector,
+// by stopping renewal and clearing HolderIdentity.
+func (e *kubeElector) Resign(ctx context.Context, key string) error {
+	e.mu.Lock()
+	stopC, ok := e.stopped[key]
+	if ok {
+		delete(e.stopped, key)
+	}
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	close(stopC)
+
+	leases := e.client.CoordinationV1().Leases(e.namespace)
+	lease, err := leases.Get(ctx, key, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	lease.Spec.HolderIdentity = nil
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+	return trace.Wrap(err)
+}
+
+// Get returns the current holder identity and Generation (used as the
+// fencing token) for the Lease named key.
+func (e *kubeElector) Get(ctx context.Context, key string) (string, int64, error) {
+	lease, err := e.client.CoordinationV1().Leases(e.namespace).Get(ctx, key, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	if lease.Spec.HolderIdentity == nil {
+		return "", 0, nil
+	}
+	return *lease.Spec.HolderIdentity, lease.Generation, nil
+}
+
+// Observe polls the Lease named key every retry and reports holder
+// identity transitions as LeaderEvents. Unlike etcdElector's push-based
+// Observe, a change is seen up to retry late, and changes that are
+// undone within one interval are not reported.
+func (e *kubeElector) Observe(ctx context.Context, key string, retry time.Duration) <-chan LeaderEvent {
+	eventsC := make(chan LeaderEvent)
+	go func() {
+		defer close(eventsC)
+		var prev string
+		var prevToken int64
+		first := true
+		ticker := time.NewTicker(retry)
+		defer ticker.Stop()
+		for {
+			value, token, err := e.Get(ctx, key)
+			if err != nil {
+				log.WithField("key", key).WithError(err).Info("Observe error.")
+			} else if first || value != prev || token != prevToken {
+				select {
+				case eventsC <- LeaderEvent{Key: key, PrevValue: prev, NewValue: value, Token: token}:
+					prev, prevToken, first = value, token, false
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return eventsC
+}
+
+// Watch polls every Lease in the namespace every retry and reports
+// per-Lease holder identity changes as PrefixEvents. prefix is matched
+// against Lease names as a string prefix.
+func (e *kubeElector) Watch(ctx context.Context, prefix string, retry time.Duration) <-chan PrefixEvent {
+	eventsC := make(chan PrefixEvent)
+	go func() {
+		defer close(eventsC)
+		state := make(map[string]string)
+		ticker := time.NewTicker(retry)
+		defer ticker.Stop()
+		for {
+			list, err := e.client.CoordinationV1().Leases(e.namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				log.WithField("key", prefix).WithError(err).Info("Watch error.")
+			} else {
+				seen := make(map[string]bool, len(list.Items))
+				for _, lease := range list.Items {
+					if len(lease.Name) < len(prefix) || lease.Name[:len(prefix)] != prefix {
+						continue
+					}
+					seen[lease.Name] = true
+					newValue := ""
+					if lease.Spec.HolderIdentity != nil {
+						newValue = *lease.Spec.HolderIdentity
+					}
+					if prevValue, ok := state[lease.Name]; !ok || prevValue != newValue {
+						prevValue := state[lease.Name]
+						state[lease.Name] = newValue
+						select {
+						case eventsC <- PrefixEvent{Key: lease.Name, PrevValue: prevValue, NewValue: newValue, Type: Put}:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				for name, prevValue := range state {
+					if seen[name] {
+						continue
+					}
+					delete(state, name)
+					select {
+					case eventsC <- PrefixEvent{Key: name, PrevValue: prevValue, Type: Delete}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return eventsC
+}
+
+// Close stops renewing any Leases still held by this elector. Unlike
+// etcdElector.Close, it does not resign them: their HolderIdentity stays
+// set until the Lease expires, unless Resign was called first.
+func (e *kubeElector) Close() error {
+	e.mu.Lock()
+	stopped := e.stopped
+	e.stopped = nil
+	e.mu.Unlock()
+	for _, stopC := range stopped {
+		close(stopC)
+	}
+	return nil
+}
+
+func strPtr(s string) *string { return &s }
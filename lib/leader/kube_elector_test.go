@@ -0,0 +1,140 @@
+package leader
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaseExpired(t *testing.T) {
+	now := metav1.NewMicroTime(time.Now())
+	past := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	durationSeconds := int32(10)
+
+	testCases := []struct {
+		comment string
+		lease   *coordinationv1.Lease
+		expired bool
+	}{
+		{
+			comment: "no renew time recorded",
+			lease:   &coordinationv1.Lease{},
+			expired: true,
+		},
+		{
+			comment: "fresh renewal",
+			lease: &coordinationv1.Lease{Spec: coordinationv1.LeaseSpec{
+				RenewTime: &now, LeaseDurationSeconds: &durationSeconds,
+			}},
+			expired: false,
+		},
+		{
+			comment: "renewal older than lease duration",
+			lease: &coordinationv1.Lease{Spec: coordinationv1.LeaseSpec{
+				RenewTime: &past, LeaseDurationSeconds: &durationSeconds,
+			}},
+			expired: true,
+		},
+	}
+	for _, testCase := range testCases {
+		if got := leaseExpired(testCase.lease); got != testCase.expired {
+			t.Errorf("%v: leaseExpired() = %v, want %v", testCase.comment, got, testCase.expired)
+		}
+	}
+}
+
+func TestTryAcquireCreatesLease(t *testing.T) {
+	e := &kubeElector{
+		client:     fake.NewSimpleClientset(),
+		namespace:  "kube-system",
+		sessionTTL: time.Second,
+	}
+	won, err := e.tryAcquire(context.Background(), "test-key", "candidate-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !won {
+		t.Fatal("expected to win an uncontested Lease")
+	}
+
+	value, _, err := e.Get(context.Background(), "test-key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "candidate-1" {
+		t.Fatalf("expected candidate-1 to hold the lease, got %q", value)
+	}
+}
+
+func TestTryAcquireRenewsOwnLease(t *testing.T) {
+	e := &kubeElector{
+		client:     fake.NewSimpleClientset(),
+		namespace:  "kube-system",
+		sessionTTL: time.Second,
+	}
+	ctx := context.Background()
+	if _, err := e.tryAcquire(ctx, "test-key", "candidate-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	won, err := e.tryAcquire(ctx, "test-key", "candidate-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !won {
+		t.Fatal("expected the existing holder to renew its own lease")
+	}
+}
+
+func TestTryAcquireRejectsLiveOtherHolder(t *testing.T) {
+	e := &kubeElector{
+		client:     fake.NewSimpleClientset(),
+		namespace:  "kube-system",
+		sessionTTL: time.Hour,
+	}
+	ctx := context.Background()
+	if _, err := e.tryAcquire(ctx, "test-key", "candidate-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	won, err := e.tryAcquire(ctx, "test-key", "candidate-2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if won {
+		t.Fatal("expected a second candidate not to win a lease still held and unexpired")
+	}
+}
+
+func TestTryAcquireTakesOverExpiredLease(t *testing.T) {
+	e := &kubeElector{
+		client:     fake.NewSimpleClientset(),
+		namespace:  "kube-system",
+		sessionTTL: time.Millisecond,
+	}
+	ctx := context.Background()
+	if _, err := e.tryAcquire(ctx, "test-key", "candidate-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	won, err := e.tryAcquire(ctx, "test-key", "candidate-2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !won {
+		t.Fatal("expected a second candidate to take over an expired lease")
+	}
+
+	value, _, err := e.Get(ctx, "test-key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "candidate-2" {
+		t.Fatalf("expected candidate-2 to hold the lease, got %q", value)
+	}
+}
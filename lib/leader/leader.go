@@ -1,63 +1,75 @@
 package leader
 
 import (
-	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gravitational/planet/lib/etcdconf"
-	"github.com/gravitational/planet/lib/utils"
 	"github.com/gravitational/trace"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/coreos/etcd/client"
-	"github.com/mailgun/timetools"
 	"golang.org/x/net/context"
 )
 
-// defaultResponseTimeout specifies the default time limit to wait for response
-// header in a single request made by an etcd client
-const defaultResponseTimeout = 1 * time.Second
+// defaultSessionTTL is the default duration of the lease backing each
+// election session.
+const defaultSessionTTL = 10 * time.Second
 
 // Config sets leader election configuration options
 type Config struct {
-	// ETCD defines etcd configuration
+	// ETCD defines etcd configuration. Only used when Backend is
+	// BackendETCD.
 	ETCD etcdconf.Config
-	// Clock is a time provider
-	Clock timetools.TimeProvider
+	// Backend selects the coordination backend leadership is
+	// campaigned and observed through. Defaults to BackendETCD.
+	Backend Backend
+	// Namespace is the Kubernetes namespace Lease objects are created
+	// in. Only used when Backend is BackendKubeLease; defaults to
+	// "kube-system".
+	Namespace string
+	// SessionTTL is the TTL of the lease backing each election
+	// session. If a voter process dies or is partitioned, its session
+	// (and hence its leadership) expires after this interval.
+	SessionTTL time.Duration
 }
 
-// Client implements ETCD-backed leader election client
-// that helps to elect new leaders for a given key and
-// monitors the changes to the leaders
+// Client implements leader election, electing new leaders for a given
+// key and monitoring the changes to the leaders, on top of a pluggable
+// LeaderElector backend
 type Client struct {
-	client client.Client
-	clock  timetools.TimeProvider
-	closeC chan bool
-	closed uint32
+	elector LeaderElector
+	closeC  chan struct{}
+	closed  uint32
+	wg      sync.WaitGroup
 }
 
 // NewClient returns a new instance of leader election client
 func NewClient(cfg Config) (*Client, error) {
-	if len(cfg.ETCD.Endpoints) == 0 {
-		return nil, trace.Errorf("need at least one endpoint")
+	if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = defaultSessionTTL
 	}
-	if cfg.Clock == nil {
-		cfg.Clock = &timetools.RealTime{}
-	}
-	if cfg.ETCD.HeaderTimeoutPerRequest == 0 {
-		cfg.ETCD.HeaderTimeoutPerRequest = defaultResponseTimeout
+	if cfg.Backend == "" {
+		cfg.Backend = BackendETCD
 	}
 
-	client, err := cfg.ETCD.NewClient()
+	var elector LeaderElector
+	var err error
+	switch cfg.Backend {
+	case BackendETCD:
+		elector, err = newEtcdElector(cfg)
+	case BackendKubeLease:
+		elector, err = newKubeElector(cfg)
+	default:
+		return nil, trace.BadParameter("unknown leader election backend: %v", cfg.Backend)
+	}
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 
 	return &Client{
-		client: client,
-		clock:  cfg.Clock,
-		closeC: make(chan bool),
+		elector: elector,
+		closeC:  make(chan struct{}),
 	}, nil
 }
 
@@ -70,9 +82,11 @@ type CallbackFn func(key, prevValue, newValue string)
 // previous values for the key. In the first call, both values are the same
 // and reflect the value of the key at that moment
 func (l *Client) AddWatchCallback(key string, retry time.Duration, fn CallbackFn) {
+	l.wg.Add(1)
 	go func() {
+		defer l.wg.Done()
 		valuesC := make(chan string)
-		l.AddWatch(key, retry, valuesC)
+		l.addWatch(key, retry, valuesC)
 		var prev string
 		for {
 			select {
@@ -86,224 +100,294 @@ func (l *Client) AddWatchCallback(key string, retry time.Duration, fn CallbackFn
 	}()
 }
 
+// CallbackFnV2 is the richer variant of CallbackFn: in addition to the
+// previous and new values for key, it carries the fencing token that
+// was current for newValue. Callers that perform a side-effectful
+// action on the strength of "I am watching the leader key" should pass
+// this token along in a backend-specific compare-and-swap (e.g.
+// clientv3.Compare(clientv3.ModRevision(key), "=", token)) so the write
+// is rejected if another process has since taken over.
+type CallbackFnV2 func(key, prevValue, newValue string, token int64)
+
+// AddWatchCallbackV2 behaves like AddWatchCallback, except the callback
+// also receives the fencing token of the key's current value, letting
+// the caller guard subsequent writes against split-brain.
+func (l *Client) AddWatchCallbackV2(key string, retry time.Duration, fn CallbackFnV2) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		eventsC := make(chan LeaderEvent)
+		l.addWatchV2(key, retry, eventsC)
+		var prev string
+		for {
+			select {
+			case <-l.closeC:
+				return
+			case ev := <-eventsC:
+				fn(key, prev, ev.NewValue, ev.Token)
+				prev = ev.NewValue
+			}
+		}
+	}()
+}
+
 // AddWatch starts watching the key for changes and sending them
-// to the valuesC, the watch is stopped
+// to valuesC
 func (l *Client) AddWatch(key string, retry time.Duration, valuesC chan string) {
-	prefix := fmt.Sprintf("AddWatch(key=%v)", key)
-	api := client.NewKeysAPI(l.client)
+	l.wg.Add(1)
 	go func() {
-		backoff := &utils.Backoff{
-			Initial: 50 * time.Millisecond,
-			Max:     10 * time.Second,
-		}
+		defer l.wg.Done()
+		l.addWatch(key, retry, valuesC)
+	}()
+}
 
-		var watcher client.Watcher
-		var re *client.Response
-		var err error
-
-		resetWatch := func() error {
-			// make sure we've sent the existing value first,
-			// so we can reliably detect the transitions
-			re, err = l.getFirstValue(key, retry)
-			if err != nil {
-				log.Errorf("%v unexpected error: %v, returning", prefix, err)
-				return err
-			} else if re == nil {
-				log.Infof("%v client is closing, return", prefix)
-				return err
-			}
-			log.Infof("%v got current value '%v' for key '%v'", prefix, re.Node.Value, key)
-			watcher = api.Watcher(key, &client.WatcherOptions{
-				AfterIndex: re.Node.ModifiedIndex,
-			})
-			log.Infof("%v reset watch at %v", prefix, re.Node.ModifiedIndex)
-			return nil
+// addWatch relays the elector's LeaderEvent stream for key as bare
+// values on valuesC, for callers that only care about the value.
+func (l *Client) addWatch(key string, retry time.Duration, valuesC chan string) {
+	ctx, cancel := l.contextUntilClosed()
+	defer cancel()
+	for ev := range l.elector.Observe(ctx, key, retry) {
+		select {
+		case valuesC <- ev.NewValue:
+		case <-l.closeC:
+			return
 		}
+	}
+}
 
-		err = resetWatch()
-		if err != nil {
+// addWatchV2 relays the elector's LeaderEvent stream for key directly
+// onto eventsC.
+func (l *Client) addWatchV2(key string, retry time.Duration, eventsC chan LeaderEvent) {
+	ctx, cancel := l.contextUntilClosed()
+	defer cancel()
+	for ev := range l.elector.Observe(ctx, key, retry) {
+		select {
+		case eventsC <- ev:
+		case <-l.closeC:
 			return
 		}
+	}
+}
 
-		ctx, closer := context.WithCancel(context.Background())
-		go func() {
-			<-l.closeC
-			closer()
-		}()
+// EventType distinguishes the two kinds of change AddPrefixWatch reports
+// for a key under the watched prefix.
+type EventType int
 
-		for {
-			re, err = watcher.Next(ctx)
-			if err == nil {
-				if re.Node.Value == "" {
-					log.Infof("watcher.Next for %v skipping empty value", key)
-					continue
-				}
-				log.Infof("watcher.Next for %v got %v", key, re.Node.Value)
-				backoff.Reset()
-			}
-			if err != nil {
-				duration := backoff.Delay()
-				if backoff.Tries > 1 {
-					log.Infof("backing off for %v", duration)
-					time.Sleep(duration)
-				}
-
-				if err == context.Canceled {
-					log.Infof("client is closing, return")
-					return
-				} else if cerr, ok := err.(*client.ClusterError); ok {
-					if len(cerr.Errors) != 0 && cerr.Errors[0] == context.Canceled {
-						log.Infof("client is closing, return")
-						return
-					}
-					log.Infof("unexpected cluster error: %v (%v)", err, cerr.Detail())
-					continue
-				} else if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeEventIndexCleared {
-					log.Infof("watch index error, resetting watch index: %v", cerr)
-					err = resetWatch()
-					if err != nil {
-						continue
-					}
-				} else {
-					log.Infof("unexpected watch error: %v", err)
-					// try recreating the watch if we get repeated unknown errors
-					if backoff.Tries > 10 {
-						resetWatch()
-					}
-					continue
-				}
-			}
-			select {
-			case valuesC <- re.Node.Value:
-			case <-l.closeC:
-				return
-			}
+const (
+	// Put indicates the key was created or its value changed.
+	Put EventType = iota
+	// Delete indicates the key was removed.
+	Delete
+)
+
+// PrefixEvent describes a single change to a key under a prefix watched
+// with AddPrefixWatch.
+type PrefixEvent struct {
+	// Key is the full key the change applies to.
+	Key string
+	// PrevValue is the key's value before this change, or "" if the key
+	// did not previously exist.
+	PrevValue string
+	// NewValue is the key's value after this change. It is "" for
+	// Delete events.
+	NewValue string
+	// Type is Put or Delete.
+	Type EventType
+}
+
+// AddPrefixWatch watches all keys under prefix and sends a PrefixEvent
+// to eventsC for every create, update or delete among them. Unlike
+// AddWatch, which tracks a single key and sends only its bare value,
+// this is usable for watching sets of related keys, such as a set of
+// member leases under "/planet/members/".
+func (l *Client) AddPrefixWatch(prefix string, retry time.Duration, eventsC chan PrefixEvent) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.addPrefixWatch(prefix, retry, eventsC)
+	}()
+}
+
+func (l *Client) addPrefixWatch(prefix string, retry time.Duration, eventsC chan PrefixEvent) {
+	ctx, cancel := l.contextUntilClosed()
+	defer cancel()
+	for ev := range l.elector.Watch(ctx, prefix, retry) {
+		select {
+		case eventsC <- ev:
+		case <-l.closeC:
+			return
+		}
+	}
+}
+
+// contextUntilClosed returns a context that is canceled when either the
+// returned cancel func is called or the client is closed, whichever
+// comes first.
+func (l *Client) contextUntilClosed() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-l.closeC:
+			cancel()
+		case <-ctx.Done():
 		}
 	}()
+	return ctx, cancel
 }
 
-// AddVoter adds a voter that tries to elect given value
-// by attempting to set the key to the value for a given term duration
-// it also attempts to hold the lease indefinitely
-func (l *Client) AddVoter(key, value string, term time.Duration) error {
-	if value == "" {
-		return trace.Errorf("voter value for key can not be empty")
+// Voter is a handle to an ongoing campaign for leadership of a key,
+// returned by AddVoter. It exposes the fencing token for the term this
+// process most recently won, so callers can verify their leadership is
+// still current immediately before a side-effectful action.
+type Voter struct {
+	client *Client
+	key    string
+	value  string
+	token  int64
+}
+
+// Token returns the fencing token for the leadership term this voter
+// most recently won. It is 0 if this voter has never won a campaign.
+func (v *Voter) Token() int64 {
+	return atomic.LoadInt64(&v.token)
+}
+
+// IsLeader checks whether this voter's fencing token is still the
+// current value for its key, i.e. whether no one else has won a
+// campaign since. Callers should call this immediately before a
+// side-effectful action rather than trusting a stale CallbackFn
+// notification, which can lag reality under GC pauses or clock skew.
+func (v *Voter) IsLeader(ctx context.Context) (bool, error) {
+	token := atomic.LoadInt64(&v.token)
+	if token == 0 {
+		return false, nil
+	}
+	_, curToken, err := v.client.elector.Get(ctx, v.key)
+	if err != nil {
+		return false, trace.Wrap(err)
 	}
-	if term < time.Second {
-		return trace.Errorf("term can not be < 1second")
+	return curToken == token, nil
+}
+
+// AddVoter adds a voter that campaigns for leadership of the given key
+// with the given value, backed by the client's configured
+// LeaderElector. It campaigns indefinitely, resuming automatically
+// whenever a previous win is lost.
+//
+// term is retained for compatibility with existing callers but is no
+// longer used to drive renewal; configure Config.SessionTTL instead.
+func (l *Client) AddVoter(key, value string, term time.Duration) (*Voter, error) {
+	if value == "" {
+		return nil, trace.Errorf("voter value for key can not be empty")
 	}
+	voter := &Voter{client: l, key: key, value: value}
+	l.wg.Add(1)
 	go func() {
-		err := l.elect(key, value, term)
-		if err != nil {
-			log.Infof("voter error: %v", err)
+		defer l.wg.Done()
+		l.campaign(voter, term)
+	}()
+	return voter, nil
+}
+
+// campaign repeatedly campaigns for leadership of voter's key until the
+// client is closed, re-campaigning whenever leadership is lost. While
+// voter holds leadership, its fencing token is kept current via the
+// elector's own Observe stream; it is cleared whenever leadership is
+// lost or not yet won.
+func (l *Client) campaign(voter *Voter, term time.Duration) {
+	fields := log.Fields{"key": voter.key, "candidate": voter.value, "term": term}
+	for {
+		if l.isClosed() {
+			return
 		}
-		ticker := time.NewTicker(term / 5)
-		defer ticker.Stop()
-		for {
+
+		campaignsTotal.Inc()
+		start := time.Now()
+		ctx, cancel := l.contextUntilClosed()
+		err := l.elector.Campaign(ctx, voter.key, voter.value)
+		renewalLatency.Observe(time.Since(start).Seconds())
+		if err != nil {
+			cancel()
+			renewalFailuresTotal.Inc()
+			if l.isClosed() {
+				return
+			}
+			log.WithFields(fields).WithError(err).Info("Campaign error.")
 			select {
-			case <-ticker.C:
-				err := l.elect(key, value, term)
-				if err != nil {
-					log.Infof("voter error: %v", err)
-				}
+			case <-time.After(time.Second):
 			case <-l.closeC:
-				log.Infof("client is closing, return")
 				return
 			}
+			continue
 		}
-	}()
-	return nil
-}
 
-// getFirstValue returns the current value for key if it exists, or waits
-// for the value to appear and loops until client.Close is called
-func (l *Client) getFirstValue(key string, retryPeriod time.Duration) (*client.Response, error) {
-	api := client.NewKeysAPI(l.client)
-	tick := time.NewTicker(retryPeriod)
-	defer tick.Stop()
-	for {
-		re, err := api.Get(context.TODO(), key, nil)
-		if err == nil {
-			return re, nil
-		} else if !IsNotFound(err) {
-			log.Infof("unexpected watcher error: %v", err)
+		_, token, err := l.elector.Get(ctx, voter.key)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Info("Elected but failed to read fencing token.")
 		}
-		select {
-		case <-tick.C:
-		case <-l.closeC:
-			log.Infof("watcher got client close signal")
-			return nil, nil
+		atomic.StoreInt64(&voter.token, token)
+		electedGauge.WithLabelValues(voter.key).Set(1)
+		log.WithFields(fields).WithField("mod_revision", token).Info("Successfully elected.")
+
+		lost := l.holdLeadership(ctx, voter, fields)
+		atomic.StoreInt64(&voter.token, 0)
+		electedGauge.WithLabelValues(voter.key).Set(0)
+		cancel()
+		if !lost {
+			return
 		}
+		log.WithFields(fields).Info("Lost leadership, restarting campaign.")
 	}
 }
 
-// elect is taken from: https://github.com/kubernetes/contrib/blob/master/pod-master/podmaster.go
-// this is a slightly modified version though, that does not return the result
-// instead we rely on watchers
-func (l *Client) elect(key, value string, term time.Duration) error {
-	candidate := fmt.Sprintf("candidate(key=%v, value=%v, term=%v)", key, value, term)
-	log.Infof("%v start", candidate)
-	api := client.NewKeysAPI(l.client)
-	resp, err := api.Get(context.TODO(), key, nil)
-	if err != nil {
-		if !IsNotFound(err) {
-			return trace.Wrap(err)
-		}
-		log.Infof("%v key not found, try to elect myself", candidate)
-		// try to grab the lock for the given term
-		_, err := api.Set(context.TODO(), key, value, &client.SetOptions{
-			TTL:       term,
-			PrevExist: client.PrevNoExist,
-		})
-		if err != nil {
-			return trace.Wrap(err)
+// holdLeadership watches voter's key for as long as it still reflects
+// voter's value, keeping voter's fencing token current as the backend
+// reports new ones. It returns true if leadership was lost and the
+// caller should re-campaign, or false if the client was closed and the
+// campaign was resigned instead.
+func (l *Client) holdLeadership(ctx context.Context, voter *Voter, fields log.Fields) (lost bool) {
+	eventsC := l.elector.Observe(ctx, voter.key, time.Second)
+	for {
+		select {
+		case <-l.closeC:
+			resignCtx, resignCancel := context.WithTimeout(context.Background(), time.Second)
+			if err := l.elector.Resign(resignCtx, voter.key); err != nil {
+				log.WithFields(fields).WithError(err).Info("Resign error.")
+			}
+			resignCancel()
+			return false
+		case ev, ok := <-eventsC:
+			if !ok || ev.NewValue != voter.value {
+				return true
+			}
+			atomic.StoreInt64(&voter.token, ev.Token)
 		}
-		log.Infof("%v successfully elected", candidate)
-		return nil
-	}
-	if resp.Node.Value != value {
-		log.Infof("%v leader: is %v, try next time", candidate, resp.Node.Value)
-		return nil
-	}
-	if resp.Node.Expiration.Sub(l.clock.UtcNow()) > time.Duration(term/2) {
-		return nil
 	}
+}
 
-	// extend the lease before the current expries
-	_, err = api.Set(context.TODO(), key, value, &client.SetOptions{
-		TTL:       term,
-		PrevValue: value,
-		PrevIndex: resp.Node.ModifiedIndex,
-	})
-	if err != nil {
-		return trace.Wrap(err)
-	}
-	log.Infof("%v extended lease", candidate)
-	return nil
+func (l *Client) isClosed() bool {
+	return atomic.LoadUint32(&l.closed) == 1
 }
 
-// Close stops current operations and releases resources
+// Close stops current operations, resigning any held leadership, and
+// releases resources
 func (l *Client) Close() error {
-	// already closed
 	if !atomic.CompareAndSwapUint32(&l.closed, 0, 1) {
 		return nil
 	}
 	close(l.closeC)
-	return nil
+	l.wg.Wait()
+	return trace.Wrap(l.elector.Close())
 }
 
+// IsNotFound returns true if err indicates the key or object a
+// LeaderElector operation addressed does not exist.
 func IsNotFound(err error) bool {
-	e, ok := err.(client.Error)
-	if !ok {
-		return false
-	}
-	return e.Code == client.ErrorCodeKeyNotFound
+	return trace.IsNotFound(err)
 }
 
+// IsAlreadyExist returns true if err indicates the key or object a
+// LeaderElector operation addressed already exists.
 func IsAlreadyExist(err error) bool {
-	e, ok := err.(client.Error)
-	if !ok {
-		return false
-	}
-	return e.Code == client.ErrorCodeNodeExist
+	return trace.IsAlreadyExists(err)
 }
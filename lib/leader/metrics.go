@@ -0,0 +1,63 @@
+package leader
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Reasons a watch had to be reset and re-seeded, for the
+// planet_leader_watch_resets_total{reason=} label.
+const (
+	reasonCompacted    = "compacted"
+	reasonClusterError = "cluster_error"
+	reasonUnknown      = "unknown"
+)
+
+var (
+	campaignsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "planet",
+		Subsystem: "leader",
+		Name:      "campaigns_total",
+		Help:      "Total number of leader election campaigns started.",
+	})
+
+	electedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "planet",
+		Subsystem: "leader",
+		Name:      "elected",
+		Help:      "1 if this process currently holds leadership for key, 0 otherwise.",
+	}, []string{"key"})
+
+	renewalFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "planet",
+		Subsystem: "leader",
+		Name:      "renewal_failures_total",
+		Help:      "Total number of failed leadership campaign/renewal attempts.",
+	})
+
+	watchResetsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "planet",
+		Subsystem: "leader",
+		Name:      "watch_resets_total",
+		Help:      "Total number of times a watch was reset and re-seeded, by reason.",
+	}, []string{"reason"})
+
+	renewalLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "planet",
+		Subsystem: "leader",
+		Name:      "renewal_latency_seconds",
+		Help:      "Latency of leadership campaign/renewal round trips.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+// Collectors returns the prometheus.Collector implementations this
+// package exposes. Callers should register these with their process's
+// prometheus.Registry so leadership flapping can be alerted on without
+// scraping logs.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		campaignsTotal,
+		electedGauge,
+		renewalFailuresTotal,
+		watchResetsTotal,
+		renewalLatency,
+	}
+}